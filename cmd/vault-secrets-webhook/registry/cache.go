@@ -0,0 +1,188 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "vault_secrets_webhook",
+		Subsystem: "registry",
+		Name:      "entrypoint_cache_hits_total",
+		Help:      "Number of GetEntrypointCmd lookups served from cache.",
+	})
+	cacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "vault_secrets_webhook",
+		Subsystem: "registry",
+		Name:      "entrypoint_cache_misses_total",
+		Help:      "Number of GetEntrypointCmd lookups that required a registry round-trip.",
+	})
+	registryRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vault_secrets_webhook",
+		Subsystem: "registry",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of registry requests made while resolving entrypoint/cmd.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHitsTotal, cacheMissesTotal, registryRequestDuration)
+}
+
+// CacheEntry is what EntrypointCache stores per image digest. A non-empty
+// Err marks a negative cache entry (a config blob fetch that failed after
+// the manifest HEAD succeeded), which is kept for a shorter TTL than a
+// successful resolution. A failed manifest HEAD, such as an auth failure on
+// it, is not cached.
+type CacheEntry struct {
+	Entrypoint []string
+	Cmd        []string
+	Err        string
+}
+
+// SharedCache is a cache backend shared across webhook replicas, e.g. Redis
+// or a Kubernetes ConfigMap/CRD.
+type SharedCache interface {
+	Get(key string) (CacheEntry, bool, error)
+	Set(key string, entry CacheEntry, ttl time.Duration) error
+}
+
+type lruItem struct {
+	key     string
+	entry   CacheEntry
+	expires time.Time
+}
+
+// lruCache is a size- and TTL-bounded in-process cache.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) Get(key string) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return CacheEntry{}, false
+	}
+
+	item := el.Value.(*lruItem)
+	if time.Now().After(item.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return CacheEntry{}, false
+	}
+
+	c.ll.MoveToFront(el)
+	return item.entry, true
+}
+
+func (c *lruCache) Set(key string, entry CacheEntry, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruItem).entry = entry
+		el.Value.(*lruItem).expires = time.Now().Add(ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&lruItem{key: key, entry: entry, expires: time.Now().Add(ttl)})
+	c.items[key] = el
+
+	if c.size > 0 && c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruItem).key)
+		}
+	}
+}
+
+// EntrypointCache caches GetEntrypointCmd results keyed by resolved image
+// digest, so the mutating webhook only pays for a manifest HEAD on repeat
+// admissions of the same image and downloads the config blob on miss.
+type EntrypointCache struct {
+	local       *lruCache
+	shared      SharedCache
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+// NewEntrypointCache returns a cache with an in-process LRU tier of size
+// entries, holding successful lookups for ttl and failed ones for
+// negativeTTL. shared may be nil to disable the cross-replica tier.
+func NewEntrypointCache(size int, ttl, negativeTTL time.Duration, shared SharedCache) *EntrypointCache {
+	return &EntrypointCache{local: newLRUCache(size), shared: shared, ttl: ttl, negativeTTL: negativeTTL}
+}
+
+// Get returns the cached entry for digest, checking the in-process tier
+// before falling through to the shared tier (populating the local tier on a
+// shared hit).
+func (c *EntrypointCache) Get(digest string) (CacheEntry, bool) {
+	if entry, ok := c.local.Get(digest); ok {
+		cacheHitsTotal.Inc()
+		return entry, true
+	}
+
+	if c.shared != nil {
+		if entry, ok, err := c.shared.Get(digest); err != nil {
+			logger.Warn("Cannot read from shared entrypoint cache", zap.Error(err))
+		} else if ok {
+			c.local.Set(digest, entry, c.ttlFor(entry))
+			cacheHitsTotal.Inc()
+			return entry, true
+		}
+	}
+
+	cacheMissesTotal.Inc()
+	return CacheEntry{}, false
+}
+
+// Set stores entry for digest in both cache tiers.
+func (c *EntrypointCache) Set(digest string, entry CacheEntry) {
+	ttl := c.ttlFor(entry)
+
+	c.local.Set(digest, entry, ttl)
+
+	if c.shared != nil {
+		if err := c.shared.Set(digest, entry, ttl); err != nil {
+			logger.Warn("Cannot write to shared entrypoint cache", zap.Error(err))
+		}
+	}
+}
+
+func (c *EntrypointCache) ttlFor(entry CacheEntry) time.Duration {
+	if entry.Err != "" {
+		return c.negativeTTL
+	}
+	return c.ttl
+}
@@ -0,0 +1,103 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// configMapCacheValue is the JSON document stored per digest in the
+// ConfigMap's Data map, carrying its own expiry since ConfigMaps have no
+// native per-key TTL.
+type configMapCacheValue struct {
+	Entry     CacheEntry `json:"entry"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+}
+
+// ConfigMapCache is a SharedCache backed by a single Kubernetes ConfigMap,
+// for clusters that would rather not run Redis. It is best suited to small,
+// low-churn caches: every Set rewrites the whole ConfigMap.
+type ConfigMapCache struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapCache returns a ConfigMapCache backed by the ConfigMap
+// name/namespace, which must already exist.
+func NewConfigMapCache(clientset kubernetes.Interface, namespace, name string) *ConfigMapCache {
+	return &ConfigMapCache{clientset: clientset, namespace: namespace, name: name}
+}
+
+func (c *ConfigMapCache) Get(key string) (CacheEntry, bool, error) {
+	cm, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+	if err != nil {
+		return CacheEntry{}, false, fmt.Errorf("cannot read ConfigMap %s/%s: %w", c.namespace, c.name, err)
+	}
+
+	raw, ok := cm.Data[key]
+	if !ok {
+		return CacheEntry{}, false, nil
+	}
+
+	var value configMapCacheValue
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return CacheEntry{}, false, fmt.Errorf("cannot unmarshal cached entry: %w", err)
+	}
+
+	if time.Now().After(value.ExpiresAt) {
+		return CacheEntry{}, false, nil
+	}
+
+	return value.Entry, true, nil
+}
+
+// Set writes key into the ConfigMap, retrying the whole read-modify-write on
+// a resourceVersion conflict so that concurrent writers (e.g. multiple
+// webhook replicas updating different keys at once) don't silently drop each
+// other's writes.
+func (c *ConfigMapCache) Set(key string, entry CacheEntry, ttl time.Duration) error {
+	value, err := json.Marshal(configMapCacheValue{Entry: entry, ExpiresAt: time.Now().Add(ttl)})
+	if err != nil {
+		return fmt.Errorf("cannot marshal cache entry: %w", err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("cannot read ConfigMap %s/%s: %w", c.namespace, c.name, err)
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[key] = string(value)
+
+		_, err = c.clientset.CoreV1().ConfigMaps(c.namespace).Update(cm)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot update ConfigMap %s/%s: %w", c.namespace, c.name, err)
+	}
+	return nil
+}
+
+var _ SharedCache = (*ConfigMapCache)(nil)
@@ -0,0 +1,76 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestConfigMapCacheGetSetRoundTrips(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cache", Namespace: "default"},
+	})
+	cache := NewConfigMapCache(clientset, "default", "cache")
+
+	if err := cache.Set("sha256:abc", CacheEntry{Cmd: []string{"/bin/sh"}}, time.Minute); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	entry, ok, err := cache.Get("sha256:abc")
+	if err != nil || !ok {
+		t.Fatalf("Get() = %+v, %v, %v", entry, ok, err)
+	}
+	if entry.Cmd[0] != "/bin/sh" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}
+
+func TestConfigMapCacheSetRetriesOnConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cache", Namespace: "default"},
+	})
+
+	conflicted := false
+	clientset.PrependReactor("update", "configmaps", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		if !conflicted {
+			conflicted = true
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "cache", fmt.Errorf("conflict"))
+		}
+		return false, nil, nil
+	})
+
+	cache := NewConfigMapCache(clientset, "default", "cache")
+	if err := cache.Set("sha256:abc", CacheEntry{Cmd: []string{"/bin/sh"}}, time.Minute); err != nil {
+		t.Fatalf("Set() error = %v, want the conflict to be retried transparently", err)
+	}
+	if !conflicted {
+		t.Fatal("expected the fake client to have returned a conflict at least once")
+	}
+
+	entry, ok, err := cache.Get("sha256:abc")
+	if err != nil || !ok || entry.Cmd[0] != "/bin/sh" {
+		t.Fatalf("expected the retried write to have succeeded, got %+v, %v, %v", entry, ok, err)
+	}
+}
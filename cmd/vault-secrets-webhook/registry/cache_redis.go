@@ -0,0 +1,65 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisCache is a SharedCache backed by Redis, letting replicas of the
+// mutating webhook share resolved entrypoint/cmd results.
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisCache returns a RedisCache using client, namespacing all keys
+// under keyPrefix (e.g. "vault-secrets-webhook:registry:").
+func NewRedisCache(client *redis.Client, keyPrefix string) *RedisCache {
+	return &RedisCache{client: client, prefix: keyPrefix}
+}
+
+func (c *RedisCache) Get(key string) (CacheEntry, bool, error) {
+	value, err := c.client.Get(context.Background(), c.prefix+key).Result()
+	if err == redis.Nil {
+		return CacheEntry{}, false, nil
+	}
+	if err != nil {
+		return CacheEntry{}, false, fmt.Errorf("cannot read from redis: %w", err)
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		return CacheEntry{}, false, fmt.Errorf("cannot unmarshal cached entry: %w", err)
+	}
+	return entry, true, nil
+}
+
+func (c *RedisCache) Set(key string, entry CacheEntry, ttl time.Duration) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot marshal cache entry: %w", err)
+	}
+
+	if err := c.client.Set(context.Background(), c.prefix+key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("cannot write to redis: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEntrypointCacheHitsAndMisses(t *testing.T) {
+	cache := NewEntrypointCache(10, time.Minute, time.Second, nil)
+
+	if _, ok := cache.Get("sha256:abc"); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+
+	cache.Set("sha256:abc", CacheEntry{Entrypoint: []string{"/bin/sh"}, Cmd: []string{"-c", "true"}})
+
+	entry, ok := cache.Get("sha256:abc")
+	if !ok {
+		t.Fatal("expected a hit after Set")
+	}
+	if entry.Entrypoint[0] != "/bin/sh" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}
+
+func TestEntrypointCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewEntrypointCache(2, time.Minute, time.Minute, nil)
+
+	cache.Set("a", CacheEntry{Cmd: []string{"a"}})
+	cache.Set("b", CacheEntry{Cmd: []string{"b"}})
+	cache.Set("c", CacheEntry{Cmd: []string{"c"}})
+
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("expected the oldest entry to have been evicted")
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Fatal("expected the most recently set entry to still be cached")
+	}
+}
+
+func TestEntrypointCacheNegativeEntriesExpireFaster(t *testing.T) {
+	cache := NewEntrypointCache(10, time.Hour, 10*time.Millisecond, nil)
+
+	cache.Set("sha256:bad", CacheEntry{Err: "unauthorized"})
+
+	if _, ok := cache.Get("sha256:bad"); !ok {
+		t.Fatal("expected the negative entry to be cached immediately")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := cache.Get("sha256:bad"); ok {
+		t.Fatal("expected the negative entry to have expired")
+	}
+}
+
+type fakeSharedCache struct {
+	store map[string]CacheEntry
+}
+
+func (f *fakeSharedCache) Get(key string) (CacheEntry, bool, error) {
+	entry, ok := f.store[key]
+	return entry, ok, nil
+}
+
+func (f *fakeSharedCache) Set(key string, entry CacheEntry, ttl time.Duration) error {
+	if f.store == nil {
+		f.store = map[string]CacheEntry{}
+	}
+	f.store[key] = entry
+	return nil
+}
+
+func TestEntrypointCacheFallsThroughToSharedTier(t *testing.T) {
+	shared := &fakeSharedCache{store: map[string]CacheEntry{
+		"sha256:shared": {Cmd: []string{"from-shared"}},
+	}}
+
+	cache := NewEntrypointCache(10, time.Minute, time.Second, shared)
+
+	entry, ok := cache.Get("sha256:shared")
+	if !ok || entry.Cmd[0] != "from-shared" {
+		t.Fatalf("expected to fall through to the shared cache, got %+v, %v", entry, ok)
+	}
+}
+
+func TestLRUCacheConcurrentAccess(t *testing.T) {
+	cache := newLRUCache(100)
+
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			key := fmt.Sprintf("key-%d", i)
+			cache.Set(key, CacheEntry{Cmd: []string{key}}, time.Minute)
+			cache.Get(key)
+			done <- struct{}{}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// RegistryOptions carries per-request TLS settings for talking to a
+// registry, so that one insecure private registry no longer taints every
+// other lookup in the same process.
+type RegistryOptions struct {
+	SkipTLSVerify bool
+	CABundle      []byte
+	ClientCert    []byte
+	ClientKey     []byte
+	HTTPTransport http.RoundTripper
+
+	// Platform picks the manifest list entry to resolve, e.g.
+	// "linux/amd64". Defaults to defaultPlatform when empty.
+	Platform string
+}
+
+const defaultPlatform = "linux/amd64"
+
+// transport returns the http.RoundTripper to use for this request: the
+// caller-supplied one if set, otherwise one built from the TLS fields.
+func (o RegistryOptions) transport() (http.RoundTripper, error) {
+	if o.HTTPTransport != nil {
+		return o.HTTPTransport, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.SkipTLSVerify} // nolint:gosec
+
+	if len(o.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(o.CABundle) {
+			return nil, fmt.Errorf("cannot parse CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(o.ClientCert) > 0 || len(o.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{TLSClientConfig: tlsConfig}, nil
+}
+
+// registryOptionsJSON is the on-disk representation of a per-registry entry
+// in a RegistryOptions policy file, similar in spirit to registries.conf.
+type registryOptionsJSON struct {
+	Insecure   bool   `json:"insecure"`
+	CABundle   string `json:"caBundle"`
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+	Platform   string `json:"platform"`
+}
+
+// LoadRegistryOptionsPolicy reads a JSON document mapping registry hostnames
+// to their RegistryOptions, e.g.:
+//
+//	{"harbor.internal": {"insecure": true, "caBundle": "-----BEGIN..."}}
+func LoadRegistryOptionsPolicy(path string) (map[string]RegistryOptions, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]registryOptionsJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal registry options policy: %w", err)
+	}
+
+	policy := make(map[string]RegistryOptions, len(raw))
+	for host, entry := range raw {
+		policy[host] = RegistryOptions{
+			SkipTLSVerify: entry.Insecure,
+			CABundle:      []byte(entry.CABundle),
+			ClientCert:    []byte(entry.ClientCert),
+			ClientKey:     []byte(entry.ClientKey),
+			Platform:      entry.Platform,
+		}
+	}
+	return policy, nil
+}
+
+var registryOptionsPolicy map[string]RegistryOptions
+
+// SetRegistryOptionsPolicy installs the per-registry RegistryOptions used by
+// GetEntrypointCmd. Pass nil to reset to defaults for every registry.
+func SetRegistryOptionsPolicy(policy map[string]RegistryOptions) {
+	registryOptionsPolicy = policy
+}
+
+func registryOptionsFor(host string) RegistryOptions {
+	if opts, ok := registryOptionsPolicy[host]; ok {
+		return opts
+	}
+	return RegistryOptions{}
+}
@@ -0,0 +1,79 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryOptionsTransportHonorsHTTPTransportOverride(t *testing.T) {
+	custom := &http.Transport{}
+	opts := RegistryOptions{HTTPTransport: custom}
+
+	transport, err := opts.transport()
+	if err != nil {
+		t.Fatalf("transport() error = %v", err)
+	}
+	if transport != custom {
+		t.Fatal("expected the caller-supplied transport to be used unchanged")
+	}
+}
+
+func TestRegistryOptionsTransportBuildsTLSConfig(t *testing.T) {
+	opts := RegistryOptions{SkipTLSVerify: true}
+
+	transport, err := opts.transport()
+	if err != nil {
+		t.Fatalf("transport() error = %v", err)
+	}
+
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected *http.Transport, got %T", transport)
+	}
+	if !httpTransport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("expected InsecureSkipVerify to propagate from SkipTLSVerify")
+	}
+}
+
+func TestLoadRegistryOptionsPolicy(t *testing.T) {
+	path := writeTempFile(t, `{"harbor.internal": {"insecure": true, "platform": "linux/arm64"}}`)
+
+	policy, err := LoadRegistryOptionsPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadRegistryOptionsPolicy() error = %v", err)
+	}
+
+	opts, ok := policy["harbor.internal"]
+	if !ok {
+		t.Fatal("expected a policy entry for harbor.internal")
+	}
+	if !opts.SkipTLSVerify || opts.Platform != "linux/arm64" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "registry-options.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("cannot write temp file: %v", err)
+	}
+	return path
+}
@@ -0,0 +1,71 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// CredentialHelper resolves credentials for a registry on demand, mirroring
+// the Docker credential helper protocol (credsStore/credHelpers).
+type CredentialHelper interface {
+	Get(registry string) (username, password string, err error)
+}
+
+// execCredentialHelper shells out to a `docker-credential-<name>` binary on
+// PATH, following the documented credential helper protocol: the registry
+// URL is written to stdin as a JSON {"ServerURL": ...} object and the
+// response is read back as JSON from stdout.
+type execCredentialHelper struct {
+	name string
+}
+
+// newExecCredentialHelper returns a CredentialHelper backed by the
+// `docker-credential-<name>` binary, e.g. "ecr-login", "gcr", "osxkeychain".
+func newExecCredentialHelper(name string) CredentialHelper {
+	return &execCredentialHelper{name: name}
+}
+
+func (h *execCredentialHelper) Get(registry string) (string, string, error) {
+	binary := fmt.Sprintf("docker-credential-%s", h.name)
+
+	stdin, err := json.Marshal(struct {
+		ServerURL string `json:"ServerURL"`
+	}{ServerURL: registry})
+	if err != nil {
+		return "", "", fmt.Errorf("cannot marshal credential helper request: %w", err)
+	}
+
+	cmd := exec.Command(binary, "get")
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("cannot run %s: %w", binary, err)
+	}
+
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", "", fmt.Errorf("cannot unmarshal %s output: %w", binary, err)
+	}
+
+	return resp.Username, resp.Secret, nil
+}
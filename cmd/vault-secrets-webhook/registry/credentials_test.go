@@ -0,0 +1,83 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// installFakeCredentialHelper writes an executable docker-credential-<name>
+// script to a temp dir, prepends it to PATH, and returns the path to the
+// file the script will have written the request's stdin to, so the test can
+// assert on what execCredentialHelper actually sent.
+func installFakeCredentialHelper(t *testing.T, name, response string) (stdinCapturePath string) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("fake credential helper script is a shell script")
+	}
+
+	dir := t.TempDir()
+	stdinCapturePath = filepath.Join(dir, "stdin.json")
+
+	script := fmt.Sprintf("#!/bin/sh\ncat > %q\ncat <<'EOF'\n%s\nEOF\n", stdinCapturePath, response)
+	scriptPath := filepath.Join(dir, "docker-credential-"+name)
+	if err := ioutil.WriteFile(scriptPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("cannot write fake credential helper: %v", err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return stdinCapturePath
+}
+
+func TestExecCredentialHelperGetParsesHelperOutput(t *testing.T) {
+	stdinCapturePath := installFakeCredentialHelper(t, "faketest", `{"Username":"produser","Secret":"prodpass"}`)
+
+	user, pass, err := newExecCredentialHelper("faketest").Get("registry.example.com")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if user != "produser" || pass != "prodpass" {
+		t.Fatalf("Get() = %q, %q, want produser, prodpass", user, pass)
+	}
+
+	stdin, err := ioutil.ReadFile(stdinCapturePath)
+	if err != nil {
+		t.Fatalf("cannot read captured stdin: %v", err)
+	}
+	if want := `{"ServerURL":"registry.example.com"}`; string(stdin) != want {
+		t.Fatalf("helper received stdin %q, want %q", stdin, want)
+	}
+}
+
+func TestExecCredentialHelperGetReturnsErrorOnMalformedOutput(t *testing.T) {
+	installFakeCredentialHelper(t, "brokentest", `not json`)
+
+	if _, _, err := newExecCredentialHelper("brokentest").Get("registry.example.com"); err == nil {
+		t.Fatal("expected an error when the helper's output cannot be parsed")
+	}
+}
+
+func TestExecCredentialHelperGetReturnsErrorWhenHelperMissing(t *testing.T) {
+	if _, _, err := newExecCredentialHelper("does-not-exist-really").Get("registry.example.com"); err == nil {
+		t.Fatal("expected an error when the docker-credential-<name> binary is not on PATH")
+	}
+}
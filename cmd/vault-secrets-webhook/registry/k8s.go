@@ -0,0 +1,312 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// registryAuthFileEnv points at a static .dockerconfigjson-style file used as
+// a fallback source of credentials for pods that carry no imagePullSecrets
+// of their own (directly or via their ServiceAccount).
+const registryAuthFileEnv = "REGISTRY_AUTH_FILE"
+
+// registryAuthStrictEnv, when set to "true", makes GetEntrypointCmd abort
+// when no credentials can be resolved for an image instead of the default
+// of falling back to an anonymous pull (matching pre-existing behavior for
+// public images).
+const registryAuthStrictEnv = "REGISTRY_AUTH_STRICT"
+
+func registryAuthStrict() bool {
+	return os.Getenv(registryAuthStrictEnv) == "true"
+}
+
+// dockerHubAliases are the hostnames that all refer to the default Docker Hub
+// registry. Pull secrets are commonly keyed by any one of these.
+var dockerHubAliases = []string{
+	"docker.io",
+	"index.docker.io",
+	"registry-1.docker.io",
+	"https://index.docker.io/v1/",
+}
+
+const defaultDockerHubHost = "registry-1.docker.io"
+
+// dockerConfigEntry is a single entry under the "auths" key of a
+// .dockerconfigjson/.dockercfg file, keyed by registry host (optionally with
+// a path, e.g. "quay.io/myorg").
+type dockerConfigEntry struct {
+	host       string
+	auth       dockerTypes.AuthConfig
+	credHelper string // name of the docker-credential-<name> helper to use when auth is empty
+}
+
+// K8s structure keeps information retrieved from POD definition
+type K8s struct {
+	clientset        kubernetes.Interface
+	Namespace        string
+	RegistryAddress  string
+	RegistryName     string
+	RegistryUsername string
+	RegistryPassword string
+	Image            string
+}
+
+func (k *K8s) readDockerSecret(namespace, secretName string) (map[string][]byte, error) {
+	secret, err := k.clientset.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// serviceAccountPullSecrets returns the names of the imagePullSecrets attached
+// to the pod's ServiceAccount, if any.
+func (k *K8s) serviceAccountPullSecrets(namespace, serviceAccountName string) ([]string, error) {
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+
+	sa, err := k.clientset.CoreV1().ServiceAccounts(namespace).Get(serviceAccountName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(sa.ImagePullSecrets))
+	for _, ref := range sa.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	return names, nil
+}
+
+// decodeDockerSecret parses a Kubernetes secret's data into docker config
+// entries, supporting both the modern .dockerconfigjson format and the
+// legacy .dockercfg format.
+func decodeDockerSecret(data map[string][]byte) ([]dockerConfigEntry, error) {
+	if cfg, ok := data[corev1.DockerConfigJsonKey]; ok {
+		return decodeDockerConfigBytes(cfg)
+	}
+
+	if cfg, ok := data[corev1.DockerConfigKey]; ok {
+		var raw map[string]dockerTypes.AuthConfig
+		if err := json.Unmarshal(cfg, &raw); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal %s: %w", corev1.DockerConfigKey, err)
+		}
+		return authsToEntries(raw, "", nil), nil
+	}
+
+	return nil, fmt.Errorf("secret does not contain %s or %s", corev1.DockerConfigJsonKey, corev1.DockerConfigKey)
+}
+
+// decodeDockerConfigBytes parses a raw docker config.json document (the
+// format stored under .dockerconfigjson, and also used by a static
+// REGISTRY_AUTH_FILE), including any credsStore/credHelpers directives.
+func decodeDockerConfigBytes(cfg []byte) ([]dockerConfigEntry, error) {
+	var creds struct {
+		Auths       map[string]dockerTypes.AuthConfig `json:"auths"`
+		CredsStore  string                            `json:"credsStore"`
+		CredHelpers map[string]string                 `json:"credHelpers"`
+	}
+	if err := json.Unmarshal(cfg, &creds); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal docker config: %w", err)
+	}
+
+	return authsToEntries(creds.Auths, creds.CredsStore, creds.CredHelpers), nil
+}
+
+// authsToEntries normalizes a docker config's "auths" map into
+// dockerConfigEntry values, resolving which credential helper (if any)
+// applies to each registry: a per-registry entry in credHelpers takes
+// precedence over the global credsStore.
+func authsToEntries(auths map[string]dockerTypes.AuthConfig, credsStore string, credHelpers map[string]string) []dockerConfigEntry {
+	entries := make([]dockerConfigEntry, 0, len(auths))
+	for rawHost, auth := range auths {
+		host := normalizeRegistryHost(rawHost)
+
+		helper := credsStore
+		if h, ok := credHelpers[rawHost]; ok {
+			helper = h
+		}
+
+		entries = append(entries, dockerConfigEntry{host: host, auth: auth, credHelper: helper})
+	}
+	return entries
+}
+
+// normalizeRegistryHost strips a scheme/trailing path conventionally used in
+// .dockerconfigjson keys (e.g. "https://index.docker.io/v1/") down to a bare
+// host[/path], and maps Docker Hub aliases onto a single canonical host.
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.TrimSuffix(host, "/v1/")
+	host = strings.TrimSuffix(host, "/v2/")
+	host = strings.TrimSuffix(host, "/")
+
+	for _, alias := range dockerHubAliases {
+		if host == strings.TrimSuffix(strings.TrimPrefix(alias, "https://"), "/v1/") {
+			return defaultDockerHubHost
+		}
+	}
+
+	return host
+}
+
+// registryHostForImage returns the registry host (and, for Docker Hub
+// images, the canonical host) that an image reference resolves against.
+func registryHostForImage(image string) string {
+	repo, _ := ParseContainerImage(image)
+
+	if slash := strings.Index(repo, "/"); slash > 0 {
+		candidate := repo[:slash]
+		if strings.ContainsAny(candidate, ".:") || candidate == "localhost" {
+			return normalizeRegistryHost(candidate)
+		}
+	}
+
+	return defaultDockerHubHost
+}
+
+// resolveAuth finds the best-matching entry for image among entries,
+// preferring the most specific (longest) path-scoped match. It returns the
+// registry host the image resolves against alongside the matched entry.
+func resolveAuth(entries []dockerConfigEntry, image string) (dockerConfigEntry, string, bool) {
+	host := registryHostForImage(image)
+	repo, _ := ParseContainerImage(image)
+
+	var best dockerConfigEntry
+	var bestLen = -1
+	found := false
+
+	for _, entry := range entries {
+		entryHost := entry.host
+		entryPath := ""
+		if idx := strings.Index(entry.host, "/"); idx >= 0 {
+			entryHost = entry.host[:idx]
+			entryPath = entry.host[idx:]
+		}
+
+		if entryHost != host {
+			continue
+		}
+
+		if entryPath != "" {
+			prefix := entryHost + entryPath
+			if !strings.HasPrefix(repo, prefix) {
+				continue
+			}
+			if rest := repo[len(prefix):]; rest != "" && rest[0] != '/' {
+				continue
+			}
+		}
+
+		if len(entryPath) > bestLen {
+			best = entry
+			bestLen = len(entryPath)
+			found = true
+		}
+	}
+
+	if !found {
+		return dockerConfigEntry{}, "", false
+	}
+
+	return best, host, true
+}
+
+// Load reads all imagePullSecrets reachable from the pod (those listed
+// directly on the pod spec, plus those attached to its ServiceAccount),
+// decodes them, and resolves credentials for container.Image by matching
+// the image's registry hostname. It returns an error when no credentials
+// could be resolved; callers may choose to continue with an anonymous pull.
+func (k *K8s) Load(container *corev1.Container, podSpec *corev1.PodSpec) error {
+	k.Image = container.Image
+
+	secretNames := make([]string, 0, len(podSpec.ImagePullSecrets))
+	for _, ref := range podSpec.ImagePullSecrets {
+		secretNames = append(secretNames, ref.Name)
+	}
+
+	saSecretNames, err := k.serviceAccountPullSecrets(k.Namespace, podSpec.ServiceAccountName)
+	if err != nil {
+		logger.Warn("Cannot read imagePullSecrets from ServiceAccount", err)
+	} else {
+		secretNames = append(secretNames, saSecretNames...)
+	}
+
+	var entries []dockerConfigEntry
+	for _, name := range secretNames {
+		if name == "" {
+			continue
+		}
+
+		data, err := k.readDockerSecret(k.Namespace, name)
+		if err != nil {
+			logger.Warn("Cannot read imagePullSecrets", err)
+			continue
+		}
+
+		decoded, err := decodeDockerSecret(data)
+		if err != nil {
+			logger.Warn("Cannot unmarshal docker configuration from imagePullSecrets", err)
+			continue
+		}
+
+		entries = append(entries, decoded...)
+	}
+
+	if len(entries) == 0 {
+		if path := os.Getenv(registryAuthFileEnv); path != "" {
+			cfg, err := ioutil.ReadFile(path)
+			if err != nil {
+				logger.Warn("Cannot read static registry auth file", err)
+			} else if decoded, err := decodeDockerConfigBytes(cfg); err != nil {
+				logger.Warn("Cannot unmarshal static registry auth file", err)
+			} else {
+				entries = decoded
+			}
+		}
+	}
+
+	entry, host, ok := resolveAuth(entries, k.Image)
+	if !ok {
+		return fmt.Errorf("no credentials found for registry %q among %d imagePullSecrets", registryHostForImage(k.Image), len(secretNames))
+	}
+
+	username, password := entry.auth.Username, entry.auth.Password
+	if username == "" && password == "" && entry.credHelper != "" {
+		helperUser, helperPass, err := newExecCredentialHelper(entry.credHelper).Get(host)
+		if err != nil {
+			return fmt.Errorf("cannot resolve credentials via %s credential helper: %w", entry.credHelper, err)
+		}
+		username, password = helperUser, helperPass
+	}
+
+	k.RegistryName = host
+	k.RegistryAddress = fmt.Sprintf("https://%s", host)
+	k.RegistryUsername = username
+	k.RegistryPassword = password
+
+	return nil
+}
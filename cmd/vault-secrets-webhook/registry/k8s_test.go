@@ -0,0 +1,204 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func dockerConfigSecret(name, namespace string, auths map[string]map[string]string) *corev1.Secret {
+	cfg, _ := json.Marshal(map[string]interface{}{"auths": auths})
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: cfg},
+	}
+}
+
+func TestLoadResolvesAcrossMultiplePodSecrets(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		dockerConfigSecret("dockerhub", "default", map[string]map[string]string{
+			"https://index.docker.io/v1/": {"username": "hubuser", "password": "hubpass"},
+		}),
+		dockerConfigSecret("quay", "default", map[string]map[string]string{
+			"quay.io": {"username": "quayuser", "password": "quaypass"},
+		}),
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default"}},
+	)
+
+	podSpec := &corev1.PodSpec{
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "dockerhub"}, {Name: "quay"}},
+	}
+
+	k := &K8s{Namespace: "default", clientset: clientset}
+	if err := k.Load(&corev1.Container{Image: "quay.io/myorg/app:v1"}, podSpec); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if k.RegistryUsername != "quayuser" || k.RegistryPassword != "quaypass" {
+		t.Fatalf("expected quay.io credentials, got %s/%s", k.RegistryUsername, k.RegistryPassword)
+	}
+}
+
+func TestLoadResolvesServiceAccountSecrets(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		dockerConfigSecret("sa-secret", "default", map[string]map[string]string{
+			"gcr.io": {"username": "gcruser", "password": "gcrpass"},
+		}),
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "builder", Namespace: "default"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "sa-secret"}},
+		},
+	)
+
+	podSpec := &corev1.PodSpec{ServiceAccountName: "builder"}
+
+	k := &K8s{Namespace: "default", clientset: clientset}
+	if err := k.Load(&corev1.Container{Image: "gcr.io/my-project/app:v1"}, podSpec); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if k.RegistryUsername != "gcruser" || k.RegistryPassword != "gcrpass" {
+		t.Fatalf("expected gcr.io credentials, got %s/%s", k.RegistryUsername, k.RegistryPassword)
+	}
+}
+
+func TestLoadReturnsErrorWhenNoCredentialsMatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		dockerConfigSecret("dockerhub", "default", map[string]map[string]string{
+			"docker.io": {"username": "hubuser", "password": "hubpass"},
+		}),
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default"}},
+	)
+
+	podSpec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "dockerhub"}}}
+
+	k := &K8s{Namespace: "default", clientset: clientset}
+	if err := k.Load(&corev1.Container{Image: "quay.io/myorg/app:v1"}, podSpec); err == nil {
+		t.Fatal("expected an error when no credentials match the image registry")
+	}
+}
+
+func TestRegistryHostForImageNormalizesDockerHubAliases(t *testing.T) {
+	for _, image := range []string{
+		"docker.io/library/nginx:latest",
+		"index.docker.io/library/nginx:latest",
+		"registry-1.docker.io/library/nginx:latest",
+		"library/nginx:latest",
+	} {
+		if host := registryHostForImage(image); host != defaultDockerHubHost {
+			t.Fatalf("registryHostForImage(%q) = %q, want %q", image, host, defaultDockerHubHost)
+		}
+	}
+}
+
+func TestLoadResolvesExplicitDockerHubAliasAgainstSecret(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		dockerConfigSecret("dockerhub", "default", map[string]map[string]string{
+			"docker.io": {"username": "hubuser", "password": "hubpass"},
+		}),
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default"}},
+	)
+
+	podSpec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "dockerhub"}}}
+
+	k := &K8s{Namespace: "default", clientset: clientset}
+	if err := k.Load(&corev1.Container{Image: "docker.io/library/nginx:latest"}, podSpec); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if k.RegistryUsername != "hubuser" || k.RegistryPassword != "hubpass" {
+		t.Fatalf("expected docker.io credentials, got %s/%s", k.RegistryUsername, k.RegistryPassword)
+	}
+}
+
+func TestRegistryAuthStrictDefaultsToFalse(t *testing.T) {
+	if registryAuthStrict() {
+		t.Fatal("expected REGISTRY_AUTH_STRICT to default to false so pods without imagePullSecrets can still pull public images")
+	}
+}
+
+func TestResolveAuthPrefersLongestPathMatch(t *testing.T) {
+	entries := []dockerConfigEntry{
+		{host: "quay.io", auth: dockerTypes.AuthConfig{Username: "generic", Password: "generic"}},
+		{host: "quay.io/myorg", auth: dockerTypes.AuthConfig{Username: "scoped", Password: "scoped"}},
+	}
+
+	entry, host, ok := resolveAuth(entries, "quay.io/myorg/app:v1")
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	if host != "quay.io" {
+		t.Fatalf("expected host quay.io, got %s", host)
+	}
+	if entry.auth.Username != "scoped" {
+		t.Fatalf("expected the path-scoped entry to win, got username %s", entry.auth.Username)
+	}
+}
+
+func TestResolveAuthRequiresPathSegmentBoundary(t *testing.T) {
+	entries := []dockerConfigEntry{
+		{host: "quay.io/myorg", auth: dockerTypes.AuthConfig{Username: "myorg", Password: "myorg"}},
+	}
+
+	if _, _, ok := resolveAuth(entries, "quay.io/myorgextra/app:v1"); ok {
+		t.Fatal("expected an image under a sibling path sharing the entry's prefix not to match")
+	}
+
+	if _, _, ok := resolveAuth(entries, "quay.io/myorg2/app:v1"); ok {
+		t.Fatal("expected an image under a different org sharing the entry's prefix not to match")
+	}
+
+	entry, host, ok := resolveAuth(entries, "quay.io/myorg/app:v1")
+	if !ok || host != "quay.io" || entry.auth.Username != "myorg" {
+		t.Fatalf("expected the exact path-scoped entry to still match, got %+v, %s, %v", entry, host, ok)
+	}
+}
+
+func TestDecodeDockerConfigBytesResolvesCredHelpers(t *testing.T) {
+	cfg := []byte(`{
+		"auths": {
+			"gcr.io": {},
+			"docker.io": {}
+		},
+		"credsStore": "osxkeychain",
+		"credHelpers": {
+			"gcr.io": "gcr"
+		}
+	}`)
+
+	entries, err := decodeDockerConfigBytes(cfg)
+	if err != nil {
+		t.Fatalf("decodeDockerConfigBytes() error = %v", err)
+	}
+
+	helpers := map[string]string{}
+	for _, e := range entries {
+		helpers[e.host] = e.credHelper
+	}
+
+	if helpers["gcr.io"] != "gcr" {
+		t.Fatalf("expected gcr.io to use the gcr helper, got %q", helpers["gcr.io"])
+	}
+	if helpers[defaultDockerHubHost] != "osxkeychain" {
+		t.Fatalf("expected docker.io to fall back to the global credsStore, got %q", helpers[defaultDockerHubHost])
+	}
+}
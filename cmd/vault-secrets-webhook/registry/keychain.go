@@ -0,0 +1,337 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"golang.org/x/oauth2/google"
+)
+
+// Keychain resolves credentials for a registry hostname without relying on
+// Kubernetes imagePullSecrets, e.g. by talking to a cloud provider's
+// metadata service or workload identity. ok is false when the keychain does
+// not recognize the registry at all, so callers can try the next one.
+type Keychain interface {
+	Resolve(registry string) (username, password string, ok bool, err error)
+}
+
+// cloudKeychains is tried, in order, once the Kubernetes pull-secret path
+// has failed to resolve credentials for an image.
+var cloudKeychains = []Keychain{
+	NewECRKeychain(),
+	NewGCRKeychain(),
+	NewACRKeychain(),
+}
+
+// resolveCloudCredentials tries each of cloudKeychains in turn, returning
+// the first one that recognizes the registry hostname.
+func resolveCloudCredentials(registry string) (username, password string, ok bool, err error) {
+	for _, keychain := range cloudKeychains {
+		username, password, ok, err = keychain.Resolve(registry)
+		if ok {
+			return username, password, ok, err
+		}
+	}
+	return "", "", false, nil
+}
+
+// ECR
+
+var ecrHostPattern = regexp.MustCompile(`^\d+\.dkr\.ecr\.[a-z0-9-]+\.amazonaws\.com$`)
+
+// ecrTokenFetcher obtains an ECR authorization token, normally by calling
+// ecr:GetAuthorizationToken using ambient AWS credentials (including IRSA).
+type ecrTokenFetcher interface {
+	GetAuthorizationToken(registry string) (username, password string, err error)
+}
+
+type ecrKeychain struct {
+	fetcher ecrTokenFetcher
+}
+
+// NewECRKeychain returns a Keychain serving *.dkr.ecr.*.amazonaws.com images
+// using the node's ambient AWS credentials.
+func NewECRKeychain() Keychain {
+	return &ecrKeychain{fetcher: &awsECRTokenFetcher{}}
+}
+
+func (k *ecrKeychain) Resolve(registry string) (string, string, bool, error) {
+	if !ecrHostPattern.MatchString(registry) {
+		return "", "", false, nil
+	}
+
+	username, password, err := k.fetcher.GetAuthorizationToken(registry)
+	if err != nil {
+		return "", "", true, fmt.Errorf("cannot obtain ECR authorization token: %w", err)
+	}
+	return username, password, true, nil
+}
+
+// awsECRTokenFetcher is the production ecrTokenFetcher, calling
+// ecr:GetAuthorizationToken via the AWS SDK using ambient credentials
+// (environment, EC2 instance profile, or IRSA).
+type awsECRTokenFetcher struct{}
+
+func (f *awsECRTokenFetcher) GetAuthorizationToken(registry string) (string, string, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return "", "", fmt.Errorf("cannot load AWS config: %w", err)
+	}
+
+	out, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(context.Background(), &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", "", fmt.Errorf("cannot call ecr:GetAuthorizationToken: %w", err)
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return "", "", fmt.Errorf("ecr:GetAuthorizationToken returned no authorization data")
+	}
+
+	return decodeECRAuthorizationToken(*out.AuthorizationData[0].AuthorizationToken)
+}
+
+// decodeECRAuthorizationToken decodes the base64 "AWS:password" token
+// returned by ecr:GetAuthorizationToken into its username/password parts.
+func decodeECRAuthorizationToken(token string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot decode ECR authorization token: %w", err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("unexpected ECR authorization token format")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// GCR / Artifact Registry
+
+var gcrHostPattern = regexp.MustCompile(`(^|\.)(gcr\.io|pkg\.dev)$`)
+
+// gcrAccessTokenSource mints an OAuth2 access token from application
+// default credentials / workload identity.
+type gcrAccessTokenSource interface {
+	AccessToken() (string, error)
+}
+
+type gcrKeychain struct {
+	tokenSource gcrAccessTokenSource
+}
+
+// NewGCRKeychain returns a Keychain serving gcr.io and Artifact Registry
+// (*.pkg.dev) images using application default credentials.
+func NewGCRKeychain() Keychain {
+	return &gcrKeychain{tokenSource: &googleADCTokenSource{}}
+}
+
+func (k *gcrKeychain) Resolve(registry string) (string, string, bool, error) {
+	if !gcrHostPattern.MatchString(registry) {
+		return "", "", false, nil
+	}
+
+	token, err := k.tokenSource.AccessToken()
+	if err != nil {
+		return "", "", true, fmt.Errorf("cannot obtain GCR access token: %w", err)
+	}
+	return "oauth2accesstoken", token, true, nil
+}
+
+var gcrScopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+
+type googleADCTokenSource struct{}
+
+func (s *googleADCTokenSource) AccessToken() (string, error) {
+	creds, err := google.FindDefaultCredentials(context.Background(), gcrScopes...)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// ACR
+
+var acrHostPattern = regexp.MustCompile(`\.azurecr\.io$`)
+
+// httpDoer is satisfied by *http.Client, and lets tests substitute a fake
+// transport without making real network calls.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// acrTokenExchanger exchanges an Azure AD access token for an ACR refresh
+// token via the registry's /oauth2/exchange endpoint.
+type acrTokenExchanger interface {
+	Exchange(loginServer, aadAccessToken, tenantID string) (refreshToken string, err error)
+}
+
+// aadTokenSource mints an Azure AD access token, normally from the node's
+// managed identity / workload identity endpoint.
+type aadTokenSource interface {
+	Token() (accessToken, tenantID string, err error)
+}
+
+type acrKeychain struct {
+	aad      aadTokenSource
+	exchange acrTokenExchanger
+}
+
+// NewACRKeychain returns a Keychain serving *.azurecr.io images by
+// exchanging an AAD token for an ACR refresh token.
+func NewACRKeychain() Keychain {
+	return &acrKeychain{
+		aad:      &imdsTokenSource{client: http.DefaultClient},
+		exchange: &httpACRTokenExchanger{client: http.DefaultClient},
+	}
+}
+
+func (k *acrKeychain) Resolve(registry string) (string, string, bool, error) {
+	if !acrHostPattern.MatchString(registry) {
+		return "", "", false, nil
+	}
+
+	accessToken, tenantID, err := k.aad.Token()
+	if err != nil {
+		return "", "", true, fmt.Errorf("cannot obtain AAD access token: %w", err)
+	}
+
+	refreshToken, err := k.exchange.Exchange(registry, accessToken, tenantID)
+	if err != nil {
+		return "", "", true, fmt.Errorf("cannot exchange AAD token for an ACR refresh token: %w", err)
+	}
+
+	return "00000000-0000-0000-0000-000000000000", refreshToken, true, nil
+}
+
+// imdsAADTokenURL requests an Azure AD access token for the ARM audience
+// from the Azure Instance Metadata Service available to any VM/pod on the
+// node, without any credential configuration.
+const imdsAADTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F"
+
+type imdsTokenSource struct {
+	client httpDoer
+}
+
+func (s *imdsTokenSource) Token() (string, string, error) {
+	req, err := http.NewRequest(http.MethodGet, imdsAADTokenURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot reach instance metadata service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("instance metadata service returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", "", fmt.Errorf("cannot decode instance metadata service response: %w", err)
+	}
+
+	tenantID, err := tenantIDFromJWT(body.AccessToken)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot extract tenant ID from AAD access token: %w", err)
+	}
+
+	return body.AccessToken, tenantID, nil
+}
+
+// tenantIDFromJWT extracts the "tid" claim from an AAD access token without
+// verifying its signature. Verification is unnecessary here: the token was
+// just minted for us by the instance metadata service over a link-local
+// address, not supplied by an untrusted party.
+func tenantIDFromJWT(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("cannot decode JWT payload: %w", err)
+	}
+
+	var claims struct {
+		TenantID string `json:"tid"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("cannot unmarshal JWT payload: %w", err)
+	}
+	if claims.TenantID == "" {
+		return "", fmt.Errorf("JWT payload does not contain a tid claim")
+	}
+
+	return claims.TenantID, nil
+}
+
+type httpACRTokenExchanger struct {
+	client httpDoer
+}
+
+func (e *httpACRTokenExchanger) Exchange(loginServer, aadAccessToken, tenantID string) (string, error) {
+	form := fmt.Sprintf(
+		"grant_type=access_token&service=%s&tenant=%s&access_token=%s",
+		loginServer, tenantID, aadAccessToken,
+	)
+
+	url := fmt.Sprintf("https://%s/oauth2/exchange", loginServer)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(form))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ACR token exchange returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	return body.RefreshToken, nil
+}
@@ -0,0 +1,202 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+type fakeECRTokenFetcher struct {
+	user, pass string
+	err        error
+}
+
+func (f *fakeECRTokenFetcher) GetAuthorizationToken(registry string) (string, string, error) {
+	return f.user, f.pass, f.err
+}
+
+func TestECRKeychainMatchesHostPattern(t *testing.T) {
+	k := &ecrKeychain{fetcher: &fakeECRTokenFetcher{user: "AWS", pass: "token"}}
+
+	user, pass, ok, err := k.Resolve("123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	if err != nil || !ok || user != "AWS" || pass != "token" {
+		t.Fatalf("Resolve() = %q, %q, %v, %v", user, pass, ok, err)
+	}
+
+	if _, _, ok, _ := k.Resolve("gcr.io"); ok {
+		t.Fatal("expected the ECR keychain to ignore non-ECR hosts")
+	}
+}
+
+type fakeGCRTokenSource struct {
+	token string
+	err   error
+}
+
+func (f *fakeGCRTokenSource) AccessToken() (string, error) { return f.token, f.err }
+
+func TestGCRKeychainMatchesHostPattern(t *testing.T) {
+	k := &gcrKeychain{tokenSource: &fakeGCRTokenSource{token: "ya29.token"}}
+
+	for _, host := range []string{"gcr.io", "eu.gcr.io", "us-docker.pkg.dev"} {
+		user, pass, ok, err := k.Resolve(host)
+		if err != nil || !ok || user != "oauth2accesstoken" || pass != "ya29.token" {
+			t.Fatalf("Resolve(%q) = %q, %q, %v, %v", host, user, pass, ok, err)
+		}
+	}
+
+	if _, _, ok, _ := k.Resolve("quay.io"); ok {
+		t.Fatal("expected the GCR keychain to ignore non-GCR hosts")
+	}
+}
+
+type fakeAADTokenSource struct {
+	accessToken, tenantID string
+}
+
+func (f *fakeAADTokenSource) Token() (string, string, error) { return f.accessToken, f.tenantID, nil }
+
+type fakeACRExchanger struct {
+	refreshToken string
+}
+
+func (f *fakeACRExchanger) Exchange(loginServer, aadAccessToken, tenantID string) (string, error) {
+	return f.refreshToken, nil
+}
+
+func TestACRKeychainMatchesHostPattern(t *testing.T) {
+	k := &acrKeychain{
+		aad:      &fakeAADTokenSource{accessToken: "aad-token", tenantID: "tenant"},
+		exchange: &fakeACRExchanger{refreshToken: "acr-refresh-token"},
+	}
+
+	_, pass, ok, err := k.Resolve("myregistry.azurecr.io")
+	if err != nil || !ok || pass != "acr-refresh-token" {
+		t.Fatalf("Resolve() = %q, %v, %v", pass, ok, err)
+	}
+
+	if _, _, ok, _ := k.Resolve("docker.io"); ok {
+		t.Fatal("expected the ACR keychain to ignore non-ACR hosts")
+	}
+}
+
+type fakeRoundTripper struct {
+	resp *http.Response
+}
+
+func (f *fakeRoundTripper) Do(req *http.Request) (*http.Response, error) {
+	return f.resp, nil
+}
+
+func TestHTTPACRTokenExchangerParsesRefreshToken(t *testing.T) {
+	body := ioutil.NopCloser(bytes.NewBufferString(`{"refresh_token":"exchanged-token"}`))
+	exchanger := &httpACRTokenExchanger{client: &fakeRoundTripper{resp: &http.Response{StatusCode: http.StatusOK, Body: body}}}
+
+	token, err := exchanger.Exchange("myregistry.azurecr.io", "aad-token", "tenant")
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if token != "exchanged-token" {
+		t.Fatalf("expected exchanged-token, got %s", token)
+	}
+}
+
+func TestDecodeECRAuthorizationTokenSplitsUsernameAndPassword(t *testing.T) {
+	token := base64.StdEncoding.EncodeToString([]byte("AWS:some-password"))
+
+	user, pass, err := decodeECRAuthorizationToken(token)
+	if err != nil {
+		t.Fatalf("decodeECRAuthorizationToken() error = %v", err)
+	}
+	if user != "AWS" || pass != "some-password" {
+		t.Fatalf("decodeECRAuthorizationToken() = %q, %q, want AWS, some-password", user, pass)
+	}
+}
+
+func TestDecodeECRAuthorizationTokenRejectsMalformedInput(t *testing.T) {
+	if _, _, err := decodeECRAuthorizationToken("not-base64!"); err == nil {
+		t.Fatal("expected an error for a non-base64 token")
+	}
+
+	if _, _, err := decodeECRAuthorizationToken(base64.StdEncoding.EncodeToString([]byte("no-colon"))); err == nil {
+		t.Fatal("expected an error for a token without a username:password separator")
+	}
+}
+
+func TestTenantIDFromJWTExtractsTidClaim(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"tid":"11111111-2222-3333-4444-555555555555"}`))
+	token := "header." + payload + ".signature"
+
+	tenantID, err := tenantIDFromJWT(token)
+	if err != nil {
+		t.Fatalf("tenantIDFromJWT() error = %v", err)
+	}
+	if tenantID != "11111111-2222-3333-4444-555555555555" {
+		t.Fatalf("tenantIDFromJWT() = %q", tenantID)
+	}
+}
+
+func TestTenantIDFromJWTRejectsMalformedToken(t *testing.T) {
+	if _, err := tenantIDFromJWT("not-a-jwt"); err == nil {
+		t.Fatal("expected an error for a token without three dot-separated parts")
+	}
+
+	missingTid := "header." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".signature"
+	if _, err := tenantIDFromJWT(missingTid); err == nil {
+		t.Fatal("expected an error when the JWT payload has no tid claim")
+	}
+}
+
+func TestIMDSTokenSourceParsesAccessTokenAndTenantID(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"tid":"66666666-7777-8888-9999-000000000000"}`))
+	accessToken := "header." + payload + ".signature"
+
+	body := ioutil.NopCloser(bytes.NewBufferString(`{"access_token":"` + accessToken + `"}`))
+	source := &imdsTokenSource{client: &fakeRoundTripper{resp: &http.Response{StatusCode: http.StatusOK, Body: body}}}
+
+	token, tenantID, err := source.Token()
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if token != accessToken {
+		t.Fatalf("Token() access token = %q, want %q", token, accessToken)
+	}
+	if tenantID != "66666666-7777-8888-9999-000000000000" {
+		t.Fatalf("Token() tenant ID = %q", tenantID)
+	}
+}
+
+func TestResolveCloudCredentialsFallsThroughKeychains(t *testing.T) {
+	original := cloudKeychains
+	defer func() { cloudKeychains = original }()
+
+	cloudKeychains = []Keychain{
+		&ecrKeychain{fetcher: &fakeECRTokenFetcher{}},
+		&gcrKeychain{tokenSource: &fakeGCRTokenSource{token: "ya29.token"}},
+	}
+
+	user, pass, ok, err := resolveCloudCredentials("gcr.io")
+	if err != nil || !ok || user != "oauth2accesstoken" || pass != "ya29.token" {
+		t.Fatalf("resolveCloudCredentials() = %q, %q, %v, %v", user, pass, ok, err)
+	}
+
+	if _, _, ok, _ := resolveCloudCredentials("quay.io"); ok {
+		t.Fatal("expected no keychain to recognize quay.io")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// MirrorRule rewrites the registry host used to fetch a manifest/blob while
+// leaving the image reference that matches imagePullSecrets untouched.
+type MirrorRule struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Insecure bool   `json:"insecure"`
+}
+
+// RegistryConfig configures image introspection for mirrors/pull-through
+// caches, typically loaded from a mounted ConfigMap.
+type RegistryConfig struct {
+	DefaultRegistry string       `json:"defaultRegistry"`
+	Mirrors         []MirrorRule `json:"mirrors"`
+}
+
+// loadRegistryConfig reads and parses a RegistryConfig from path.
+func loadRegistryConfig(path string) (*RegistryConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg RegistryConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// mirrorFor returns the first mirror rule whose From matches host, or false
+// if none match.
+func (c *RegistryConfig) mirrorFor(host string) (MirrorRule, bool) {
+	if c == nil {
+		return MirrorRule{}, false
+	}
+
+	for _, rule := range c.Mirrors {
+		if normalizeRegistryHost(rule.From) == host {
+			return rule, true
+		}
+	}
+	return MirrorRule{}, false
+}
+
+// rewrite applies the mirror rule matching host (if any) to image, returning
+// the host to contact for the manifest/blob fetch and the (possibly
+// path-prefixed) image reference to fetch from it. The original image
+// reference is always used for imagePullSecrets matching, so callers should
+// resolve credentials against host/image before calling rewrite.
+func (c *RegistryConfig) rewrite(host, image string) (mirrorHost string, mirrorImage string, insecure bool, matched bool) {
+	rule, ok := c.mirrorFor(host)
+	if !ok {
+		return "", "", false, false
+	}
+
+	to := rule.To
+	slash := strings.Index(to, "/")
+	if slash < 0 {
+		return to, image, rule.Insecure, true
+	}
+
+	return to[:slash], to[slash+1:] + "/" + image, rule.Insecure, true
+}
+
+// RegistryConfigStore holds a RegistryConfig loaded from disk and keeps it
+// up to date by watching the file for changes, so operators can roll out
+// new mirror rules without restarting the webhook.
+type RegistryConfigStore struct {
+	path    string
+	value   atomic.Value // *RegistryConfig
+	watcher *fsnotify.Watcher
+}
+
+// NewRegistryConfigStore loads path and starts watching it for changes.
+func NewRegistryConfigStore(path string) (*RegistryConfigStore, error) {
+	store := &RegistryConfigStore{path: path}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	store.watcher = watcher
+	go store.watchLoop()
+
+	return store, nil
+}
+
+func (s *RegistryConfigStore) reload() error {
+	cfg, err := loadRegistryConfig(s.path)
+	if err != nil {
+		return err
+	}
+	s.value.Store(cfg)
+	return nil
+}
+
+// Get returns the most recently loaded RegistryConfig.
+func (s *RegistryConfigStore) Get() *RegistryConfig {
+	cfg, _ := s.value.Load().(*RegistryConfig)
+	return cfg
+}
+
+// Close stops watching the config file.
+func (s *RegistryConfigStore) Close() error {
+	return s.watcher.Close()
+}
+
+func (s *RegistryConfigStore) watchLoop() {
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(s.path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := s.reload(); err != nil {
+				logger.Warn("Cannot reload registry mirror configuration", zap.Error(err), zap.String("path", s.path))
+			} else {
+				logger.Info("Reloaded registry mirror configuration", zap.String("path", s.path))
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("Registry mirror config watcher error", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistryConfigRewriteWithPathPrefix(t *testing.T) {
+	cfg := &RegistryConfig{
+		Mirrors: []MirrorRule{
+			{From: "docker.io", To: "harbor.internal/dockerhub-proxy", Insecure: true},
+		},
+	}
+
+	host, image, insecure, matched := cfg.rewrite(defaultDockerHubHost, "library/nginx:1.19")
+	if !matched {
+		t.Fatal("expected a mirror match")
+	}
+	if host != "harbor.internal" || image != "dockerhub-proxy/library/nginx:1.19" || !insecure {
+		t.Fatalf("rewrite() = %q, %q, %v", host, image, insecure)
+	}
+}
+
+func TestRegistryConfigRewriteNoMatch(t *testing.T) {
+	cfg := &RegistryConfig{Mirrors: []MirrorRule{{From: "docker.io", To: "harbor.internal/proxy"}}}
+
+	if _, _, _, matched := cfg.rewrite("quay.io", "myorg/app:v1"); matched {
+		t.Fatal("expected no mirror match for an unrelated registry")
+	}
+}
+
+func TestRegistryConfigStoreHotReloads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "registry-config.json")
+
+	if err := ioutil.WriteFile(path, []byte(`{"mirrors":[{"from":"docker.io","to":"harbor.internal/proxy"}]}`), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	store, err := NewRegistryConfigStore(path)
+	if err != nil {
+		t.Fatalf("NewRegistryConfigStore() error = %v", err)
+	}
+	defer store.Close()
+
+	if _, ok := store.Get().mirrorFor(defaultDockerHubHost); !ok {
+		t.Fatal("expected the initial mirror rule to be loaded")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"mirrors":[{"from":"quay.io","to":"harbor.internal/proxy"}]}`), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := store.Get().mirrorFor("quay.io"); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("expected the config store to pick up the updated mirror rule")
+}
@@ -15,15 +15,14 @@
 package registry
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"reflect"
 	"strings"
 
-	dockerTypes "github.com/docker/docker/api/types"
-	"github.com/heroku/docker-registry-client/registry"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
@@ -37,64 +36,49 @@ func init() {
 	logger = log.New()
 }
 
-// BlobResponse stores blob response
-type BlobResponse struct {
-	Config Config `json:"config"`
-}
-
-// Config stores Cmd and Entrypoint retrieved from blob response
-type Config struct {
-	Cmd        []string `json:"Cmd"`
-	Entrypoint []string `json:"Entrypoint"`
-}
-
-type DockerCreds struct {
-	Auths map[string]dockerTypes.AuthConfig `json:"auths"`
-}
+// GetImageBlob downloads an image's config blob from registryHost and
+// returns its Entrypoint and Cmd, selecting the manifest list entry matching
+// opts.Platform (or defaultPlatform) when image resolves to a multi-arch
+// manifest list.
+func GetImageBlob(registryHost, username, password, image string, opts RegistryOptions) ([]string, []string, error) {
+	scheme, host := splitRegistryHostScheme(registryHost)
 
-// GetImageBlob download image blob from registry
-func GetImageBlob(url, username, password, image string) ([]string, []string) {
-	imageName, tag := ParseContainerImage(image)
-
-	registrySkipVerify := os.Getenv("REGISTRY_SKIP_VERIFY")
-
-	var hub *registry.Registry
-	var err error
-
-	if registrySkipVerify == "true" {
-		hub, err = registry.NewInsecure(url, username, password)
-	} else {
-		hub, err = registry.New(url, username, password)
-	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/%s", host, image), nameOptionsForScheme(scheme)...)
 	if err != nil {
-		logger.Fatal("Cannot create client for registry", zap.Error(err))
+		return nil, nil, fmt.Errorf("cannot parse image reference: %w", err)
 	}
 
-	manifest, err := hub.ManifestV2(imageName, tag)
+	transport, err := opts.transport()
 	if err != nil {
-		logger.Fatal("Cannot download manifest for image", zap.Error(err))
+		return nil, nil, fmt.Errorf("cannot build registry transport: %w", err)
 	}
 
-	reader, err := hub.DownloadBlob(imageName, manifest.Config.Digest)
-	if reader != nil {
-		defer reader.Close()
+	platformString := opts.Platform
+	if platformString == "" {
+		platformString = defaultPlatform
 	}
+	platform, err := v1.ParsePlatform(platformString)
 	if err != nil {
-		logger.Fatal("Cannot download blob", zap.Error(err))
+		return nil, nil, fmt.Errorf("cannot parse platform %q: %w", platformString, err)
 	}
 
-	b, err := ioutil.ReadAll(reader)
+	timer := prometheus.NewTimer(registryRequestDuration.WithLabelValues("blob"))
+	img, err := remote.Image(ref,
+		remote.WithAuth(authn.FromConfig(authn.AuthConfig{Username: username, Password: password})),
+		remote.WithTransport(transport),
+		remote.WithPlatform(*platform),
+	)
+	timer.ObserveDuration()
 	if err != nil {
-		logger.Fatal("Cannot read blob", zap.Error(err))
+		return nil, nil, fmt.Errorf("cannot fetch image %s: %w", ref, err)
 	}
 
-	var msg BlobResponse
-	err = json.Unmarshal(b, &msg)
+	config, err := img.ConfigFile()
 	if err != nil {
-		logger.Fatal("Cannot unmarshal JSON", zap.Error(err))
+		return nil, nil, fmt.Errorf("cannot read image config for %s: %w", ref, err)
 	}
 
-	return msg.Config.Entrypoint, msg.Config.Cmd
+	return config.Config.Entrypoint, config.Config.Cmd, nil
 }
 
 // ParseContainerImage returns image and tag
@@ -114,7 +98,28 @@ func ParseContainerImage(image string) (string, string) {
 // GetEntrypointCmd returns entrypoint and command of container
 func GetEntrypointCmd(clientset *kubernetes.Clientset, namespace string, container *corev1.Container, podSpec *corev1.PodSpec) ([]string, []string) {
 	podInfo := K8s{Namespace: namespace, clientset: clientset}
-	podInfo.Load(container, podSpec)
+	if err := podInfo.Load(container, podSpec); err != nil {
+		host := registryHostForImage(podInfo.Image)
+		username, password, ok, cloudErr := resolveCloudCredentials(host)
+		switch {
+		case cloudErr != nil:
+			logger.Warn("Cannot resolve registry credentials via cloud keychain",
+				zap.Error(cloudErr), zap.String("registry", host))
+		case ok:
+			podInfo.RegistryName = host
+			podInfo.RegistryAddress = fmt.Sprintf("https://%s", host)
+			podInfo.RegistryUsername = username
+			podInfo.RegistryPassword = password
+		}
+
+		if podInfo.RegistryUsername == "" && podInfo.RegistryPassword == "" {
+			if registryAuthStrict() {
+				logger.Fatal("Cannot resolve registry credentials", zap.Error(err), zap.String("image", podInfo.Image))
+			}
+			logger.Warn("Cannot resolve registry credentials, falling back to anonymous pull",
+				zap.Error(err), zap.String("image", podInfo.Image))
+		}
+	}
 
 	if podInfo.RegistryName != "" {
 		logger.Info("Trimmed registry name from image name",
@@ -126,67 +131,221 @@ func GetEntrypointCmd(clientset *kubernetes.Clientset, namespace string, contain
 
 	registryAddress := podInfo.RegistryAddress
 	if registryAddress == "" {
-		registryAddress = "https://registry-1.docker.io/"
+		registryAddress = defaultRegistryAddress()
+	}
+
+	image := podInfo.Image
+	if cfg := registryConfig(); cfg != nil {
+		host := podInfo.RegistryName
+		if host == "" {
+			host = registryHostForImage(container.Image)
+		}
+
+		if mirrorHost, mirrorImage, insecure, matched := cfg.rewrite(host, image); matched {
+			logger.Info("Rewrote registry for mirror configuration",
+				zap.String("registry", host), zap.String("mirror", mirrorHost))
+
+			scheme := "https"
+			if insecure {
+				scheme = "http"
+			}
+			registryAddress = fmt.Sprintf("%s://%s", scheme, mirrorHost)
+			image = mirrorImage
+		}
 	}
+
 	logger.Infoln("I'm using registry", registryAddress, podInfo.RegistryUsername, podInfo.RegistryPassword)
 
-	return GetImageBlob(registryAddress, podInfo.RegistryUsername, podInfo.RegistryPassword, podInfo.Image)
+	opts := registryOptionsFor(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(registryAddress, "https://"), "http://"), "/"))
+	if opts.Platform == "" {
+		if platform := platformForPod(clientset, podSpec); platform != "" {
+			opts.Platform = platform
+		}
+	}
+
+	if entrypointCache == nil {
+		entrypoint, cmd, err := GetImageBlob(registryAddress, podInfo.RegistryUsername, podInfo.RegistryPassword, image, opts)
+		if err != nil {
+			return entrypointCmdOnFailure(err.Error(), image)
+		}
+		return entrypoint, cmd
+	}
+
+	digest, err := headImageDigest(registryAddress, podInfo.RegistryUsername, podInfo.RegistryPassword, image, opts)
+	if err != nil {
+		return entrypointCmdOnFailure(err.Error(), image)
+	}
+
+	if cached, ok := entrypointCache.Get(digest); ok {
+		if cached.Err != "" {
+			return entrypointCmdOnFailure(cached.Err, image)
+		}
+		return cached.Entrypoint, cached.Cmd
+	}
+
+	entrypoint, cmd, err := GetImageBlob(registryAddress, podInfo.RegistryUsername, podInfo.RegistryPassword, image, opts)
+	if err != nil {
+		entrypointCache.Set(digest, CacheEntry{Err: err.Error()})
+		return entrypointCmdOnFailure(err.Error(), image)
+	}
+
+	entrypointCache.Set(digest, CacheEntry{Entrypoint: entrypoint, Cmd: cmd})
+
+	return entrypoint, cmd
 }
 
-// K8s structure keeps information retrieved from POD definition
-type K8s struct {
-	clientset        *kubernetes.Clientset
-	Namespace        string
-	ImagePullSecrets string
-	RegistryAddress  string
-	RegistryName     string
-	RegistryUsername string
-	RegistryPassword string
-	Image            string
+// entrypointCmdOnFailure handles a failure to resolve an image's
+// entrypoint/cmd, whether from a fresh registry lookup or a cached negative
+// result. Only in registryAuthStrict mode is this treated as fatal;
+// otherwise we log and return no override, so a single broken pull secret
+// or unreachable registry doesn't repeatedly crash-loop the webhook itself
+// for every pod admission it affects.
+func entrypointCmdOnFailure(errMsg, image string) ([]string, []string) {
+	if registryAuthStrict() {
+		logger.Fatal("Cannot get entrypoint/cmd for image", zap.String("error", errMsg), zap.String("image", image))
+	}
+	logger.Warn("Cannot get entrypoint/cmd for image, leaving it unset",
+		zap.String("error", errMsg), zap.String("image", image))
+	return nil, nil
 }
 
-func (k *K8s) readDockerSecret(namespace, secretName string) (map[string][]byte, error) {
-	secret, err := k.clientset.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+// headImageDigest performs a manifest HEAD request, without downloading the
+// config blob, and returns the manifest digest prefixed with the platform
+// (e.g. "linux/amd64@sha256:..."), which is the entrypoint cache key.
+func headImageDigest(registryHost, username, password, image string, opts RegistryOptions) (string, error) {
+	scheme, host := splitRegistryHostScheme(registryHost)
+
+	ref, err := name.ParseReference(fmt.Sprintf("%s/%s", host, image), nameOptionsForScheme(scheme)...)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse image reference: %w", err)
+	}
+
+	transport, err := opts.transport()
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("cannot build registry transport: %w", err)
+	}
+
+	platformString := opts.Platform
+	if platformString == "" {
+		platformString = defaultPlatform
+	}
+	platform, err := v1.ParsePlatform(platformString)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse platform %q: %w", platformString, err)
+	}
+
+	timer := prometheus.NewTimer(registryRequestDuration.WithLabelValues("head"))
+	defer timer.ObserveDuration()
+
+	desc, err := remote.Head(ref,
+		remote.WithAuth(authn.FromConfig(authn.AuthConfig{Username: username, Password: password})),
+		remote.WithTransport(transport),
+		remote.WithPlatform(*platform),
+	)
+	if err != nil {
+		return "", fmt.Errorf("cannot HEAD manifest for %s: %w", ref, err)
+	}
+
+	return platformString + "@" + desc.Digest.String(), nil
+}
+
+// splitRegistryHostScheme strips a registryHost's scheme (defaulting to
+// "https" when none is present) and trailing slash, returning the bare host
+// alongside the scheme so callers can select an insecure (http) transport
+// for registries/mirrors configured as such.
+func splitRegistryHostScheme(registryHost string) (scheme, host string) {
+	switch {
+	case strings.HasPrefix(registryHost, "http://"):
+		return "http", strings.TrimSuffix(strings.TrimPrefix(registryHost, "http://"), "/")
+	case strings.HasPrefix(registryHost, "https://"):
+		return "https", strings.TrimSuffix(strings.TrimPrefix(registryHost, "https://"), "/")
+	default:
+		return "https", strings.TrimSuffix(registryHost, "/")
+	}
+}
+
+// nameOptionsForScheme returns the go-containerregistry name.Option needed to
+// resolve a reference over scheme: name.Insecure for "http" so an
+// http-only pull-through mirror is actually reached over http instead of
+// go-containerregistry defaulting to https and failing outright.
+func nameOptionsForScheme(scheme string) []name.Option {
+	if scheme == "http" {
+		return []name.Option{name.Insecure}
 	}
-	return secret.Data, nil
+	return nil
 }
 
-func (k *K8s) parseDockerConfig(dockerCreds DockerCreds) {
-	k.RegistryName = reflect.ValueOf(dockerCreds.Auths).MapKeys()[0].String()
-	if !strings.HasPrefix(k.RegistryName, "https://") {
-		k.RegistryAddress = fmt.Sprintf("https://%s", k.RegistryName)
-	} else {
-		k.RegistryAddress = k.RegistryName
+// nodeArchLabel and nodeOSLabel are the well-known labels Kubernetes sets on
+// every Node reporting the platform it runs, e.g. "arm64"/"linux".
+const (
+	nodeArchLabel = "kubernetes.io/arch"
+	nodeOSLabel   = "kubernetes.io/os"
+)
+
+// platformForPod returns the "os/arch" platform (e.g. "linux/arm64") of the
+// node the pod is scheduled onto, so a multi-arch manifest list resolves to
+// the entry the pod will actually run, instead of always assuming
+// defaultPlatform. Returns "" when the pod isn't node-bound yet or its node
+// cannot be read, letting the caller fall back to a configured/default
+// platform.
+func platformForPod(clientset kubernetes.Interface, podSpec *corev1.PodSpec) string {
+	if podSpec.NodeName == "" {
+		return ""
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(podSpec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		logger.Warn("Cannot read node to determine pod platform",
+			zap.Error(err), zap.String("node", podSpec.NodeName))
+		return ""
+	}
+
+	arch := node.Labels[nodeArchLabel]
+	if arch == "" {
+		return ""
+	}
+
+	osName := node.Labels[nodeOSLabel]
+	if osName == "" {
+		osName = "linux"
 	}
 
-	auths := dockerCreds.Auths
-	k.RegistryUsername = auths[k.RegistryName].Username
-	k.RegistryPassword = auths[k.RegistryName].Password
+	return fmt.Sprintf("%s/%s", osName, arch)
 }
 
-// Load reads information from k8s and load them into the structure
-func (k *K8s) Load(container *corev1.Container, podSpec *corev1.PodSpec) {
+var entrypointCache *EntrypointCache
 
-	k.Image = container.Image
+// SetEntrypointCache installs the cache used by GetEntrypointCmd to avoid a
+// manifest+config blob round-trip on every pod admission. Pass nil to
+// disable caching.
+func SetEntrypointCache(cache *EntrypointCache) {
+	entrypointCache = cache
+}
 
-	if len(podSpec.ImagePullSecrets) >= 1 {
-		k.ImagePullSecrets = podSpec.ImagePullSecrets[0].Name
+var registryConfigStore *RegistryConfigStore
 
-		if k.ImagePullSecrets != "" {
-			data, err := k.readDockerSecret(k.Namespace, k.ImagePullSecrets)
-			if err != nil {
-				logger.Fatal("Cannot read imagePullSecrets", err)
-			}
-			dockerConfig := data[corev1.DockerConfigJsonKey]
-			//parse config
-			var dockerCreds DockerCreds
-			err = json.Unmarshal(dockerConfig, &dockerCreds)
-			if err != nil {
-				logger.Fatal("Cannot unmarshal docker configuration from imagePullSecrets", err)
-			}
-			k.parseDockerConfig(dockerCreds)
-		}
+// SetRegistryConfigStore installs the RegistryConfigStore used to resolve
+// mirror/pull-through-cache rewrites for image introspection. Pass nil to
+// disable mirroring.
+func SetRegistryConfigStore(store *RegistryConfigStore) {
+	registryConfigStore = store
+}
+
+func registryConfig() *RegistryConfig {
+	if registryConfigStore == nil {
+		return nil
+	}
+	return registryConfigStore.Get()
+}
+
+// defaultRegistryAddress returns the registry to contact when no
+// imagePullSecret or cloud keychain resolved a host for the image: the
+// operator-configured RegistryConfig.DefaultRegistry when set, otherwise
+// Docker Hub, matching the pre-existing behavior of a public pull.
+func defaultRegistryAddress() string {
+	if cfg := registryConfig(); cfg != nil && cfg.DefaultRegistry != "" {
+		scheme, host := splitRegistryHostScheme(cfg.DefaultRegistry)
+		return fmt.Sprintf("%s://%s", scheme, host)
 	}
+	return "https://registry-1.docker.io/"
 }
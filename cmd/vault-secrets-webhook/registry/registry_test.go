@@ -0,0 +1,114 @@
+// Copyright © 2019 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSplitRegistryHostScheme(t *testing.T) {
+	cases := []struct {
+		registryHost string
+		wantScheme   string
+		wantHost     string
+	}{
+		{"https://quay.io", "https", "quay.io"},
+		{"http://mirror.internal:5000", "http", "mirror.internal:5000"},
+		{"quay.io/", "https", "quay.io"},
+		{"http://mirror.internal/", "http", "mirror.internal"},
+	}
+
+	for _, c := range cases {
+		scheme, host := splitRegistryHostScheme(c.registryHost)
+		if scheme != c.wantScheme || host != c.wantHost {
+			t.Fatalf("splitRegistryHostScheme(%q) = %q, %q, want %q, %q", c.registryHost, scheme, host, c.wantScheme, c.wantHost)
+		}
+	}
+}
+
+func TestNameOptionsForSchemePassesInsecureOnlyForHTTP(t *testing.T) {
+	if opts := nameOptionsForScheme("https"); len(opts) != 0 {
+		t.Fatalf("expected no name.Options for https, got %d", len(opts))
+	}
+
+	if opts := nameOptionsForScheme("http"); len(opts) != 1 {
+		t.Fatalf("expected name.Insecure for http, got %d options", len(opts))
+	}
+}
+
+func TestEntrypointCmdOnFailureReturnsNilWithoutStrictMode(t *testing.T) {
+	t.Setenv(registryAuthStrictEnv, "")
+
+	entrypoint, cmd := entrypointCmdOnFailure("unauthorized", "quay.io/myorg/app:v1")
+	if entrypoint != nil || cmd != nil {
+		t.Fatalf("entrypointCmdOnFailure() = %v, %v, want nil, nil so the pod is admitted unmutated", entrypoint, cmd)
+	}
+}
+
+func TestDefaultRegistryAddressUsesConfiguredDefaultRegistry(t *testing.T) {
+	defer SetRegistryConfigStore(nil)
+
+	store := &RegistryConfigStore{}
+	store.value.Store(&RegistryConfig{DefaultRegistry: "http://mirror.internal:5000"})
+	SetRegistryConfigStore(store)
+
+	if got := defaultRegistryAddress(); got != "http://mirror.internal:5000" {
+		t.Fatalf("defaultRegistryAddress() = %q, want http://mirror.internal:5000", got)
+	}
+}
+
+func TestPlatformForPodReadsNodeArchAndOS(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{nodeArchLabel: "arm64", nodeOSLabel: "linux"},
+		},
+	})
+
+	podSpec := &corev1.PodSpec{NodeName: "node-1"}
+	if got := platformForPod(clientset, podSpec); got != "linux/arm64" {
+		t.Fatalf("platformForPod() = %q, want linux/arm64", got)
+	}
+}
+
+func TestPlatformForPodReturnsEmptyWithoutNodeName(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	if got := platformForPod(clientset, &corev1.PodSpec{}); got != "" {
+		t.Fatalf("platformForPod() = %q, want empty string for an unscheduled pod", got)
+	}
+}
+
+func TestPlatformForPodReturnsEmptyWhenNodeUnreadable(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	podSpec := &corev1.PodSpec{NodeName: "missing-node"}
+	if got := platformForPod(clientset, podSpec); got != "" {
+		t.Fatalf("platformForPod() = %q, want empty string when the node cannot be read", got)
+	}
+}
+
+func TestDefaultRegistryAddressFallsBackToDockerHub(t *testing.T) {
+	defer SetRegistryConfigStore(nil)
+	SetRegistryConfigStore(nil)
+
+	if got := defaultRegistryAddress(); got != "https://registry-1.docker.io/" {
+		t.Fatalf("defaultRegistryAddress() = %q, want https://registry-1.docker.io/", got)
+	}
+}